@@ -0,0 +1,37 @@
+package csi
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+// bindMount exposes the netshare driver's already-mounted hostPath at
+// targetPath, the location kubelet expects a pod's volume to appear at.
+// The underlying NFS/CIFS/Ceph/EFS mount stays owned by the driver, keyed
+// by name; this is just a local bind so CSI's node-scoped target path
+// doesn't have to equal the driver's own mountpoint.
+func bindMount(hostPath, targetPath string, readonly bool) error {
+	if err := os.MkdirAll(targetPath, 0755); err != nil {
+		return err
+	}
+	args := []string{"--bind", hostPath, targetPath}
+	if out, err := exec.Command("mount", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("bind mount %s -> %s: %v: %s", hostPath, targetPath, err, out)
+	}
+	if !readonly {
+		return nil
+	}
+	remount := []string{"-o", "remount,ro,bind", targetPath}
+	if out, err := exec.Command("mount", remount...).CombinedOutput(); err != nil {
+		return fmt.Errorf("remount %s readonly: %v: %s", targetPath, err, out)
+	}
+	return nil
+}
+
+func unbindMount(targetPath string) error {
+	if out, err := exec.Command("umount", targetPath).CombinedOutput(); err != nil {
+		return fmt.Errorf("unmount %s: %v: %s", targetPath, err, out)
+	}
+	return nil
+}
@@ -0,0 +1,241 @@
+// Package csi exposes the netshare drivers (NFS, CIFS, Ceph, EFS) over the
+// Container Storage Interface, alongside the existing Docker Volume Plugin
+// front-end, so a single daemon can serve Docker Swarm nodes and
+// Kubernetes nodes side-by-side. Both front-ends dispatch to the same
+// drivers.Driver backends and therefore share Consul-backed connection
+// counting.
+package csi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+	csipb "github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc"
+
+	"github.com/cedbossneo/docker-volume-netshare/netshare/drivers"
+)
+
+const (
+	pluginName    = "netshare.csi.docker-volume-netshare"
+	pluginVersion = "1.0.0"
+
+	// volumeIDSep separates the backend name from the volume name in a
+	// CSI VolumeId, e.g. "nfs/myvolume". Unpublish/Unstage only receive
+	// the VolumeId, not the VolumeContext a Create/Publish saw, so the
+	// backend has to travel with the ID itself.
+	volumeIDSep = "/"
+)
+
+// Server implements the CSI Identity, Node and a minimal Controller
+// service on top of a set of drivers.Driver backends keyed by name (e.g.
+// "nfs", "cifs", "ceph", "efs"). The three Unimplemented*Server embeds
+// satisfy the rest of each gRPC service interface (NodeExpandVolume,
+// ControllerExpandVolume, NodeGetVolumeStats, ControllerGetVolume, the
+// forward-compat mustEmbed* methods, ...) with a standard "unimplemented"
+// error, so Server only has to define the RPCs it actually supports.
+type Server struct {
+	csipb.UnimplementedIdentityServer
+	csipb.UnimplementedNodeServer
+	csipb.UnimplementedControllerServer
+
+	mu      sync.RWMutex
+	drivers map[string]drivers.Driver
+}
+
+// NewServer builds a CSI front-end dispatching to driverMap.
+func NewServer(driverMap map[string]drivers.Driver) *Server {
+	return &Server{drivers: driverMap}
+}
+
+// Register wires the Identity, Node and Controller services onto grpcServer.
+func (s *Server) Register(grpcServer *grpc.Server) {
+	csipb.RegisterIdentityServer(grpcServer, s)
+	csipb.RegisterNodeServer(grpcServer, s)
+	csipb.RegisterControllerServer(grpcServer, s)
+}
+
+func volumeID(backend, name string) string {
+	return backend + volumeIDSep + name
+}
+
+func splitVolumeID(id string) (backend, name string, err error) {
+	parts := strings.SplitN(id, volumeIDSep, 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("volume_id %q is not of the form <backend>/<name>", id)
+	}
+	return parts[0], parts[1], nil
+}
+
+func (s *Server) driver(backend string) (drivers.Driver, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	d, ok := s.drivers[backend]
+	if !ok {
+		return nil, fmt.Errorf("no driver registered for backend %q", backend)
+	}
+	return d, nil
+}
+
+// optsFromVolumeContext translates the string map CSI hands us in
+// VolumeContext/parameters into the same opts map the Docker
+// VolumeDriver.Create path already knows how to consume. "backend" is
+// kept, not stripped: it's how the Docker front-end's own opts select a
+// policy's Backends allow-list (policy.go) and MountSpec.Backend
+// (spec.go), and CSI volumes must produce the same MountSpec/policy
+// result as their Docker-created equivalents.
+func optsFromVolumeContext(ctx map[string]string) map[string]string {
+	opts := map[string]string{}
+	for k, v := range ctx {
+		opts[k] = v
+	}
+	return opts
+}
+
+// --- Identity service ---
+
+func (s *Server) GetPluginInfo(ctx context.Context, req *csipb.GetPluginInfoRequest) (*csipb.GetPluginInfoResponse, error) {
+	return &csipb.GetPluginInfoResponse{Name: pluginName, VendorVersion: pluginVersion}, nil
+}
+
+func (s *Server) GetPluginCapabilities(ctx context.Context, req *csipb.GetPluginCapabilitiesRequest) (*csipb.GetPluginCapabilitiesResponse, error) {
+	return &csipb.GetPluginCapabilitiesResponse{
+		Capabilities: []*csipb.PluginCapability{
+			{
+				Type: &csipb.PluginCapability_Service_{
+					Service: &csipb.PluginCapability_Service{Type: csipb.PluginCapability_Service_CONTROLLER_SERVICE},
+				},
+			},
+		},
+	}, nil
+}
+
+func (s *Server) Probe(ctx context.Context, req *csipb.ProbeRequest) (*csipb.ProbeResponse, error) {
+	return &csipb.ProbeResponse{}, nil
+}
+
+// --- Controller service (minimal) ---
+
+func (s *Server) CreateVolume(ctx context.Context, req *csipb.CreateVolumeRequest) (*csipb.CreateVolumeResponse, error) {
+	backend := req.Parameters["backend"]
+	if backend == "" {
+		return nil, errors.New("parameters must set \"backend\" (nfs, cifs, ceph, efs)")
+	}
+	driver, err := s.driver(backend)
+	if err != nil {
+		return nil, err
+	}
+	opts := optsFromVolumeContext(req.Parameters)
+	opts["create"] = "true"
+	if _, err := driver.Mount(req.Name, opts); err != nil {
+		return nil, err
+	}
+	if err := driver.Unmount(req.Name); err != nil {
+		log.Warn("csi: CreateVolume could not release the provisioning mount: ", err)
+	}
+	return &csipb.CreateVolumeResponse{
+		Volume: &csipb.Volume{
+			VolumeId:      volumeID(backend, req.Name),
+			VolumeContext: req.Parameters,
+		},
+	}, nil
+}
+
+func (s *Server) DeleteVolume(ctx context.Context, req *csipb.DeleteVolumeRequest) (*csipb.DeleteVolumeResponse, error) {
+	backend, name, err := splitVolumeID(req.VolumeId)
+	if err != nil {
+		return nil, err
+	}
+	driver, err := s.driver(backend)
+	if err != nil {
+		return nil, err
+	}
+	if err := driver.Unmount(name); err != nil {
+		return nil, err
+	}
+	return &csipb.DeleteVolumeResponse{}, nil
+}
+
+func (s *Server) ControllerGetCapabilities(ctx context.Context, req *csipb.ControllerGetCapabilitiesRequest) (*csipb.ControllerGetCapabilitiesResponse, error) {
+	capability := func(t csipb.ControllerServiceCapability_RPC_Type) *csipb.ControllerServiceCapability {
+		return &csipb.ControllerServiceCapability{
+			Type: &csipb.ControllerServiceCapability_Rpc{
+				Rpc: &csipb.ControllerServiceCapability_RPC{Type: t},
+			},
+		}
+	}
+	return &csipb.ControllerGetCapabilitiesResponse{
+		Capabilities: []*csipb.ControllerServiceCapability{
+			capability(csipb.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME),
+		},
+	}, nil
+}
+
+// --- Node service ---
+
+func (s *Server) NodeStageVolume(ctx context.Context, req *csipb.NodeStageVolumeRequest) (*csipb.NodeStageVolumeResponse, error) {
+	// netshare backends mount in NodePublishVolume (the driver's own
+	// mount, then a bind onto the target path); there's no separate
+	// staging area to manage.
+	return &csipb.NodeStageVolumeResponse{}, nil
+}
+
+func (s *Server) NodeUnstageVolume(ctx context.Context, req *csipb.NodeUnstageVolumeRequest) (*csipb.NodeUnstageVolumeResponse, error) {
+	return &csipb.NodeUnstageVolumeResponse{}, nil
+}
+
+func (s *Server) NodePublishVolume(ctx context.Context, req *csipb.NodePublishVolumeRequest) (*csipb.NodePublishVolumeResponse, error) {
+	backend, name, err := splitVolumeID(req.VolumeId)
+	if err != nil {
+		return nil, err
+	}
+	driver, err := s.driver(backend)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := optsFromVolumeContext(req.VolumeContext)
+	path, err := driver.Mount(name, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := bindMount(path, req.TargetPath, req.Readonly); err != nil {
+		if unmountErr := driver.Unmount(name); unmountErr != nil {
+			log.Warn("csi: NodePublishVolume could not release mount after a failed bind: ", unmountErr)
+		}
+		return nil, err
+	}
+	return &csipb.NodePublishVolumeResponse{}, nil
+}
+
+func (s *Server) NodeUnpublishVolume(ctx context.Context, req *csipb.NodeUnpublishVolumeRequest) (*csipb.NodeUnpublishVolumeResponse, error) {
+	backend, name, err := splitVolumeID(req.VolumeId)
+	if err != nil {
+		return nil, err
+	}
+	driver, err := s.driver(backend)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := unbindMount(req.TargetPath); err != nil {
+		return nil, err
+	}
+	if err := driver.Unmount(name); err != nil {
+		return nil, err
+	}
+	return &csipb.NodeUnpublishVolumeResponse{}, nil
+}
+
+func (s *Server) NodeGetCapabilities(ctx context.Context, req *csipb.NodeGetCapabilitiesRequest) (*csipb.NodeGetCapabilitiesResponse, error) {
+	return &csipb.NodeGetCapabilitiesResponse{}, nil
+}
+
+func (s *Server) NodeGetInfo(ctx context.Context, req *csipb.NodeGetInfoRequest) (*csipb.NodeGetInfoResponse, error) {
+	return &csipb.NodeGetInfoResponse{NodeId: pluginName}, nil
+}
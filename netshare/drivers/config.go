@@ -0,0 +1,85 @@
+package drivers
+
+import (
+	"strings"
+	"time"
+)
+
+// ConsulConfig holds the connection details and tunables for the Consul
+// client used by mountManager to persist mount state across hosts.
+type ConsulConfig struct {
+	Address string
+	Token   string
+	BaseKey string
+
+	// PolicyKey is the Consul KV prefix policies are stored under, e.g.
+	// "docker-volume-netshare/policies/". Set via the plugin's
+	// --policy-key flag.
+	PolicyKey string
+
+	// LockKey is the Consul KV prefix per-volume create/delete locks are
+	// stored under, e.g. "docker-volume-netshare/locks/". It must live
+	// outside BaseKey, since GetVolumes and getConsulMountKV treat every
+	// key under BaseKey as a mount record. Defaults to a "-locks/"
+	// sibling of BaseKey when empty.
+	LockKey string
+
+	// LockTTL is the session TTL used for the per-volume create/delete
+	// lock (LockKeyPrefix()+name). Consul requires this to be between
+	// 10s and 24h.
+	LockTTL time.Duration
+
+	// LockWaitTime bounds how long Create/Delete will block trying to
+	// acquire the per-volume lock before giving up.
+	LockWaitTime time.Duration
+
+	// CASRetryLimit bounds the number of read-modify-write attempts
+	// Increment/Decrement/Add/Create/Delete will make when a Put is
+	// rejected by a concurrent CAS write from another host.
+	CASRetryLimit int
+}
+
+// LockKeyPrefix returns the Consul KV prefix per-volume locks are stored
+// under: LockKey when set, otherwise a "-locks/" sibling of BaseKey so
+// lock keys never land inside the mount-record subtree BaseKey scans.
+func (c *ConsulConfig) LockKeyPrefix() string {
+	if c.LockKey != "" {
+		return c.LockKey
+	}
+	return strings.TrimSuffix(c.BaseKey, "/") + "-locks/"
+}
+
+// VaultConfig holds the connection, TLS and authentication details used to
+// talk to Vault and fetch per-volume secrets.
+type VaultConfig struct {
+	Address string
+	BaseKey string
+
+	// TLS material for verifying Vault's server certificate (CACert or
+	// CAPath) and presenting a client certificate (ClientCert/ClientKey).
+	// Insecure must be set explicitly to skip verification; it defaults
+	// to false, unlike the old hardcoded InsecureSkipVerify behaviour.
+	CACert        string
+	CAPath        string
+	ClientCert    string
+	ClientKey     string
+	TLSServerName string
+	Insecure      bool
+
+	// AuthMethod selects how the plugin authenticates to Vault: "approle"
+	// (default), "kubernetes", or "token".
+	AuthMethod string
+
+	// RoleId/SecretId are used when AuthMethod is "approle".
+	RoleId   string
+	SecretId string
+
+	// KubernetesRole/KubernetesJWTPath are used when AuthMethod is
+	// "kubernetes". KubernetesJWTPath defaults to the projected service
+	// account token path when empty.
+	KubernetesRole    string
+	KubernetesJWTPath string
+
+	// Token is used directly when AuthMethod is "token".
+	Token string
+}
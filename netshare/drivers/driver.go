@@ -0,0 +1,24 @@
+package drivers
+
+// Driver is the minimal surface every netshare backend (NFS, CIFS, Ceph,
+// EFS) must satisfy so it can be served over more than one protocol
+// front-end. Today that's the Docker Volume Plugin API via
+// github.com/docker/go-plugins-helpers/volume; the csi package added
+// alongside this interface dispatches to the same backends over CSI.
+// Concrete drivers already implement most of this in the course of
+// satisfying volume.Driver - this is the subset a front-end actually needs
+// in order to stay protocol-agnostic.
+type Driver interface {
+	// Mount attaches the named volume (creating it first if opts asks for
+	// it, per CreateOpt) and returns the host path it was mounted at.
+	Mount(name string, opts map[string]string) (string, error)
+
+	// Unmount detaches the named volume. It is a no-op if other
+	// connections on this host still reference it.
+	Unmount(name string) error
+
+	// Capabilities reports the scope this driver supports, mirroring
+	// volume.Capability (e.g. Scope: "global" for state shared across
+	// every node via Consul).
+	Capabilities() map[string]string
+}
@@ -1,15 +1,12 @@
 package drivers
 
 import (
-	"encoding/json"
 	"errors"
 	log "github.com/Sirupsen/logrus"
 	"github.com/docker/go-plugins-helpers/volume"
 	consulApi "github.com/hashicorp/consul/api"
-	vaultApi "github.com/hashicorp/vault/api"
-	"strings"
 	"os"
-	"net/http"
+	"time"
 )
 
 const (
@@ -21,6 +18,7 @@ type mount struct {
 	Name        string
 	HostDir     string
 	Opts        map[string]string
+	Spec        *MountSpec
 	Managed     bool
 	Connections map[string]int
 }
@@ -30,28 +28,20 @@ type mountManager struct {
 	consulClient  *consulApi.Client
 	consulKV	 *consulApi.KV
 	vaultConfig *VaultConfig
-	vaultClient *vaultApi.Client
+	vault       *vaultManager
 	host		  string
+	renderer    *renderer
+	volumeCache *mountCache
 }
 
 func NewVolumeManager(consulConfig *ConsulConfig, vaultConfig *VaultConfig) *mountManager {
 	consulClient, consulKV := createConsulClient(consulConfig)
-	vaultClient := createVaultClient(vaultConfig)
+	vault := newVaultManager(vaultConfig)
 	host, _ := os.Hostname();
-	return &mountManager{vaultConfig: vaultConfig, vaultClient: vaultClient, consulClient: consulClient, consulConfig: consulConfig, consulKV: consulKV, host: host}
-}
-
-func createVaultClient(vaultConfig *VaultConfig) *vaultApi.Client {
-	config := vaultApi.DefaultConfig()
-	config.Address = vaultConfig.Address
-	config.HttpClient.Transport.(*http.Transport).TLSClientConfig.InsecureSkipVerify = true
-	vaultClient, err := vaultApi.NewClient(config)
-	if err != nil {
-		log.Fatal("err: %s", err)
-		return nil
-	}
-	log.Info("Created Vault Client. Address: ", vaultConfig.Address)
-	return vaultClient
+	m := &mountManager{vaultConfig: vaultConfig, vault: vault, consulClient: consulClient, consulConfig: consulConfig, consulKV: consulKV, host: host}
+	m.renderer = newRenderer(m)
+	m.volumeCache = newMountCache(defaultVolumeCacheSize)
+	return m
 }
 
 func createConsulClient(consulConfig *ConsulConfig) (*consulApi.Client, *consulApi.KV) {
@@ -68,34 +58,40 @@ func createConsulClient(consulConfig *ConsulConfig) (*consulApi.Client, *consulA
 }
 
 func (m *mountManager) getConsulMount(name string) *mount {
+	mount, _ := m.getConsulMountKV(name)
+	return mount
+}
+
+// getConsulMountKV returns both the decoded mount and the raw KVPair it was
+// read from, so callers that need to write it back can do so with a CAS
+// against the ModifyIndex they actually read.
+func (m *mountManager) getConsulMountKV(name string) (*mount, *consulApi.KVPair) {
 	key, _, err := m.consulKV.Get(m.consulConfig.BaseKey+name, nil)
 	if err != nil {
 		log.Error(err)
 	}
 	if key == nil {
-		return nil
+		return nil, nil
+	}
+	mount, err := decodeMount(key.Value)
+	if err != nil {
+		log.Error(err)
+		return nil, key
 	}
-	mount := mount{}
-	json.Unmarshal(key.Value, &mount)
 	log.Info("Retrieve mount ", mount.Name, " from consul")
-	return &mount
+	return mount, key
 }
 
 func (m *mountManager) getVaultConfig(name string) map[string]interface{} {
-	if m.vaultClient == nil {
+	if m.vault == nil {
 		return nil
 	}
-	secret, err := m.vaultClient.Logical().Write("auth/approle/login", map[string]interface{}{
-		"role_id": m.vaultConfig.RoleId,
-		"secret_id": m.vaultConfig.SecretId,
-	})
+	data, err := m.vault.Read(m.vaultConfig.BaseKey + name)
 	if err != nil {
-		log.Println(err)
+		log.Error(err)
 		return nil
 	}
-	m.vaultClient.SetToken(secret.Auth.ClientToken)
-	secret, err = m.vaultClient.Logical().Read(m.vaultConfig.BaseKey + name)
-	return secret.Data
+	return data
 }
 
 func (m *mountManager) FillVaultConfigInMount(name string) *mount {
@@ -120,20 +116,93 @@ func (m *mountManager) FillVaultConfigInOpts(name string, opts map[string]string
 	return opts
 }
 
-func (m *mountManager) putConsulMount(mount *mount) error {
-	key, _, err := m.consulKV.Get(m.consulConfig.BaseKey+mount.Name, nil)
+// putConsulMount writes mnt back to Consul with a check-and-set against
+// original's ModifyIndex (original may be nil for a brand new key, which
+// CASes against index 0 so two hosts can't both "create" the same name).
+// It returns false, nil when the CAS was rejected because someone else
+// modified the key first - callers must re-read and retry.
+func (m *mountManager) putConsulMount(original *consulApi.KVPair, mnt *mount) (bool, error) {
+	key := &consulApi.KVPair{Key: m.consulConfig.BaseKey + mnt.Name}
+	if original != nil {
+		key.ModifyIndex = original.ModifyIndex
+	}
+	value, err := encodeMount(mnt)
+	if err != nil {
+		return false, err
+	}
+	key.Value = value
+	ok, _, err := m.consulKV.CAS(key, nil)
 	if err != nil {
 		log.Error(err)
+		return false, err
+	}
+	if !ok {
+		log.Warn("CAS conflict putting mount ", mnt.Name, " in consul")
+		return false, nil
+	}
+	log.Info("Put mount ", mnt.Name, " in consul")
+	return true, nil
+}
+
+// updateConsulMount runs a read-modify-write loop against Consul, making
+// up to CASRetryLimit attempts in all (at least one) and retrying whenever
+// another host's concurrent write wins the CAS race. mutate is given the current mount (nil if it doesn't exist
+// yet) and returns the mount to persist; a nil return means no write is
+// needed.
+func (m *mountManager) updateConsulMount(name string, mutate func(*mount) *mount) (*mount, error) {
+	limit := m.consulConfig.CASRetryLimit
+	if limit <= 0 {
+		limit = 1
+	}
+	var lastErr error
+	for attempt := 0; attempt < limit; attempt++ {
+		current, kv := m.getConsulMountKV(name)
+		next := mutate(current)
+		if next == nil {
+			return current, nil
+		}
+		ok, err := m.putConsulMount(kv, next)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return next, nil
+		}
+		lastErr = errors.New("mount " + name + " was concurrently modified")
+	}
+	return nil, lastErr
+}
+
+// withLock serialises create/delete for a single volume name across every
+// host in the cluster using a Consul session-backed lock, so a create on
+// one host can't race a delete on another. fn runs only once the lock is
+// held; the lock and its session are released before withLock returns.
+func (m *mountManager) withLock(name string, fn func() error) error {
+	lock, err := m.consulClient.LockOpts(&consulApi.LockOptions{
+		Key:          m.consulConfig.LockKeyPrefix() + name,
+		SessionTTL:   m.consulConfig.LockTTL.String(),
+		LockWaitTime: m.consulConfig.LockWaitTime,
+	})
+	if err != nil {
 		return err
 	}
-	if key == nil {
-		key = &consulApi.KVPair{Key: m.consulConfig.BaseKey + mount.Name}
+
+	stopCh := make(chan struct{})
+	if m.consulConfig.LockWaitTime > 0 {
+		timer := time.AfterFunc(m.consulConfig.LockWaitTime, func() { close(stopCh) })
+		defer timer.Stop()
 	}
-	jsonMount, _ := json.Marshal(mount)
-	key.Value = jsonMount
-	_, err = m.consulKV.Put(key, nil)
-	log.Info("Put mount ", mount.Name, " in consul")
-	return err
+
+	leaderCh, err := lock.Lock(stopCh)
+	if err != nil {
+		return err
+	}
+	if leaderCh == nil {
+		return errors.New("timed out waiting for lock on volume " + name)
+	}
+	defer lock.Unlock()
+
+	return fn()
 }
 
 func (m *mountManager) deleteConsulMount(name string) error {
@@ -186,11 +255,7 @@ func (m *mountManager) GetOption(name, key string) string {
 }
 
 func (m *mountManager) GetOptionAsBool(name, key string) bool {
-	rv := strings.ToLower(m.GetOption(name, key))
-	if rv == "yes" || rv == "true" {
-		return true
-	}
-	return false
+	return parseOptBool(m.GetOption(name, key))
 }
 
 func (m *mountManager) IsActiveMount(name string) bool {
@@ -206,44 +271,84 @@ func (m *mountManager) Count(name string) int {
 	return 0
 }
 
-func (m *mountManager) Add(name, hostdir string) {
-	mnt := m.getConsulMount(name)
-	if mnt != nil {
-		m.Increment(name)
-	} else {
+func (m *mountManager) Add(name, hostdir string) error {
+	_, err := m.updateConsulMount(name, func(mnt *mount) *mount {
+		if mnt != nil {
+			mnt.Connections[m.host]++
+			return mnt
+		}
 		c := map[string]int{}
 		c[m.host] = 1
-		mnt := &mount{Name: name, HostDir: hostdir, Managed: false, Connections: c}
-		m.putConsulMount(mnt)
+		return &mount{Name: name, HostDir: hostdir, Managed: false, Connections: c}
+	})
+	return err
+}
+
+func (m *mountManager) Create(name, hostdir string, opts map[string]string) (*mount, error) {
+	policed, err := m.applyPolicy(opts)
+	if err != nil {
+		return nil, err
 	}
+	rendered, err := m.renderer.renderOpts(policed)
+	if err != nil {
+		return nil, err
+	}
+	spec, err := FromOpts(rendered)
+	if err != nil {
+		return nil, err
+	}
+
+	var created *mount
+	err = m.withLock(name, func() error {
+		result, err := m.updateConsulMount(name, func(mnt *mount) *mount {
+			if mnt != nil && mnt.Connections[m.host] > 0 {
+				mnt.Opts = rendered
+				mnt.Spec = spec
+				return mnt
+			}
+			c := map[string]int{}
+			c[m.host] = 0
+			return &mount{Name: name, HostDir: hostdir, Managed: true, Opts: rendered, Spec: spec, Connections: c}
+		})
+		created = result
+		return err
+	})
+	return created, err
 }
 
-func (m *mountManager) Create(name, hostdir string, opts map[string]string) *mount {
+// GetSpec returns the typed MountSpec for name, translating from the
+// legacy flat Opts map when an older daemon wrote this record before
+// MountSpec existed.
+func (m *mountManager) GetSpec(name string) (*MountSpec, error) {
 	mnt := m.getConsulMount(name)
-	if mnt != nil && mnt.Connections[m.host] > 0 {
-		mnt.Opts = opts
-		m.putConsulMount(mnt)
-		return mnt
-	} else {
-		c := map[string]int{}
-		c[m.host] = 0
-		mnt := &mount{Name: name, HostDir: hostdir, Managed: true, Opts: opts, Connections: c}
-		m.putConsulMount(mnt)
-		return mnt
+	if mnt == nil {
+		return nil, nil
+	}
+	if mnt.Spec != nil {
+		return mnt.Spec, nil
 	}
+	return FromOpts(mnt.Opts)
+}
+
+// RenderOpts re-evaluates a set of mount options against the current
+// Consul/Vault state. Drivers call this from Mount, just before invoking
+// the backend, so that {{ key }}/{{ secret }} directives resolve to each
+// host's own view rather than whatever was in scope at Create time.
+func (m *mountManager) RenderOpts(opts map[string]string) (map[string]string, error) {
+	return m.renderer.renderOpts(opts)
 }
 
 func (m *mountManager) Delete(name string) error {
-	log.Debugf("Delete volume: %s, connections: %d", name, m.Count(name))
-	if m.HasMount(name) {
-		if m.Count(name) < 1 {
-			m.deleteConsulMount(name)
-			return nil
+	return m.withLock(name, func() error {
+		log.Debugf("Delete volume: %s, connections: %d", name, m.Count(name))
+		if m.HasMount(name) {
+			if m.Count(name) < 1 {
+				return m.deleteConsulMount(name)
+			}
+			return errors.New("Volume is currently in use")
 		}
-		return errors.New("Volume is currently in use")
-	}
-	m.deleteConsulMount(name)
-	return nil
+		return m.deleteConsulMount(name)
+	})
 }
 
 func (m *mountManager) DeleteIfNotManaged(name string) error {
@@ -259,22 +364,39 @@ func (m *mountManager) DeleteIfNotManaged(name string) error {
 }
 
 func (m *mountManager) Increment(name string) int {
-	mount := m.getConsulMount(name)
-	if mount != nil {
-		mount.Connections[m.host]++
-		m.putConsulMount(mount)
-		return mount.Connections[m.host]
+	result, err := m.updateConsulMount(name, func(mnt *mount) *mount {
+		if mnt == nil {
+			return nil
+		}
+		mnt.Connections[m.host]++
+		return mnt
+	})
+	if err != nil {
+		log.Error(err)
+		return 0
 	}
-	return 0
+	if result == nil {
+		return 0
+	}
+	return result.Connections[m.host]
 }
 
 func (m *mountManager) Decrement(name string) int {
-	mount := m.getConsulMount(name)
-	if mount != nil && mount.Connections[m.host] > 0 {
-		mount.Connections[m.host]--
-		m.putConsulMount(mount)
+	result, err := m.updateConsulMount(name, func(mnt *mount) *mount {
+		if mnt == nil || mnt.Connections[m.host] <= 0 {
+			return nil
+		}
+		mnt.Connections[m.host]--
+		return mnt
+	})
+	if err != nil {
+		log.Error(err)
+		return 0
 	}
-	return 0
+	if result == nil {
+		return 0
+	}
+	return result.Connections[m.host]
 }
 
 func (m *mountManager) GetVolumes(rootPath string) []*volume.Volume {
@@ -287,9 +409,17 @@ func (m *mountManager) GetVolumes(rootPath string) []*volume.Volume {
 		return volumes
 	}
 	for _, val := range keys {
-		mount := mount{}
-		json.Unmarshal(val.Value, &mount)
-		volumes = append(volumes, &volume.Volume{Name: mount.Name, Mountpoint: mount.HostDir})
+		mnt, ok := m.volumeCache.get(val.Key, val.ModifyIndex)
+		if !ok {
+			decoded, err := decodeMount(val.Value)
+			if err != nil {
+				log.Error(err)
+				continue
+			}
+			mnt = decoded
+			m.volumeCache.put(val.Key, val.ModifyIndex, mnt)
+		}
+		volumes = append(volumes, &volume.Volume{Name: mnt.Name, Mountpoint: mnt.HostDir})
 	}
 	return volumes
 }
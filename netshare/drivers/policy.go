@@ -0,0 +1,262 @@
+package drivers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	log "github.com/Sirupsen/logrus"
+	consulApi "github.com/hashicorp/consul/api"
+)
+
+// PolicyOpt is the opts key a volume Create uses to name the policy it
+// should be validated and defaulted against.
+const PolicyOpt = "policy"
+
+// Policy declares the defaults, constraints and required secrets for
+// volumes of a given class, stored under ConsulConfig.PolicyKey. Attaching
+// policy=<name> to a Create's opts tells mountManager to validate the
+// incoming opts against it and merge in its defaults, so ops can say "any
+// volume created with policy=nfs-prod gets these mount flags, this Vault
+// path, and is size-capped at 100G" without every `docker run` carrying
+// the full option list.
+type Policy struct {
+	Name string
+
+	// Backends lists the drivers this policy may be used with (e.g.
+	// "nfs", "cifs", "ceph", "efs"). Empty means any backend is allowed.
+	Backends []string
+
+	// Defaults are merged into incoming opts for any key the caller
+	// didn't already set.
+	Defaults map[string]string
+
+	// Required lists option keys that must be present, after defaults
+	// are merged in, or Create is rejected.
+	Required []string
+
+	// AllowUnknownKeys, when false (the default), rejects any opts key
+	// that isn't a default, isn't required, isn't the policy key itself,
+	// and isn't one FromOpts maps onto a MountSpec field (share, create,
+	// backend, o, size, username, ...).
+	AllowUnknownKeys bool
+
+	// MaxSizeBytes clamps opts["size"] down to this value, whatever the
+	// backend. Zero means unlimited.
+	MaxSizeBytes int64
+
+	// FSType is the default filesystem for formatted volumes created
+	// under this policy, e.g. "xfs".
+	FSType string
+
+	// VaultPaths documents the Vault paths volumes under this policy are
+	// expected to pull credentials from.
+	VaultPaths []string
+}
+
+func (m *mountManager) policyKey(name string) string {
+	return m.consulConfig.PolicyKey + name
+}
+
+// GetPolicy returns the named policy, or nil if it doesn't exist.
+func (m *mountManager) GetPolicy(name string) (*Policy, error) {
+	kv, _, err := m.consulKV.Get(m.policyKey(name), nil)
+	if err != nil {
+		return nil, err
+	}
+	if kv == nil {
+		return nil, nil
+	}
+	policy := Policy{}
+	if err := json.Unmarshal(kv.Value, &policy); err != nil {
+		return nil, err
+	}
+	return &policy, nil
+}
+
+// PutPolicy creates or replaces the named policy.
+func (m *mountManager) PutPolicy(policy *Policy) error {
+	data, err := json.Marshal(policy)
+	if err != nil {
+		return err
+	}
+	_, err = m.consulKV.Put(&consulApi.KVPair{Key: m.policyKey(policy.Name), Value: data}, nil)
+	return err
+}
+
+// DeletePolicy removes the named policy. Volumes already created under it
+// keep whatever defaults were merged in at Create time.
+func (m *mountManager) DeletePolicy(name string) error {
+	_, err := m.consulKV.Delete(m.policyKey(name), nil)
+	return err
+}
+
+// ListPolicies returns every policy under ConsulConfig.PolicyKey.
+func (m *mountManager) ListPolicies() ([]*Policy, error) {
+	pairs, _, err := m.consulKV.List(m.consulConfig.PolicyKey, nil)
+	if err != nil {
+		return nil, err
+	}
+	policies := []*Policy{}
+	for _, pair := range pairs {
+		policy := Policy{}
+		if err := json.Unmarshal(pair.Value, &policy); err != nil {
+			log.Error(err)
+			continue
+		}
+		policies = append(policies, &policy)
+	}
+	return policies, nil
+}
+
+// applyPolicy looks up the policy named in opts[PolicyOpt] (if any),
+// validates opts against it, and returns a new opts map with the policy's
+// defaults merged in. It is a no-op when opts doesn't name a policy.
+func (m *mountManager) applyPolicy(opts map[string]string) (map[string]string, error) {
+	name, ok := opts[PolicyOpt]
+	if !ok || name == "" {
+		return opts, nil
+	}
+
+	policy, err := m.GetPolicy(name)
+	if err != nil {
+		return nil, err
+	}
+	if policy == nil {
+		return nil, fmt.Errorf("policy %q not found", name)
+	}
+
+	if len(policy.Backends) > 0 {
+		backend := opts["backend"]
+		allowed := false
+		for _, b := range policy.Backends {
+			if b == backend {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return nil, fmt.Errorf("policy %q does not allow backend %q", name, backend)
+		}
+	}
+
+	merged := merge(opts, policy.Defaults)
+
+	for _, required := range policy.Required {
+		if _, ok := merged[required]; !ok {
+			return nil, fmt.Errorf("policy %q requires option %q", name, required)
+		}
+	}
+
+	if !policy.AllowUnknownKeys {
+		// Anything FromOpts recognizes by name (share, create, backend,
+		// ro, o, fstype, size, username, password, vault-path,
+		// consul-path, ...) is always allowed; only keys it can't place
+		// in a MountSpec field - landing in spec.Extra - need an
+		// explicit policy Default or Required declaration.
+		spec, err := FromOpts(merged)
+		if err != nil {
+			return nil, err
+		}
+		// PolicyOpt itself always lands in spec.Extra (FromOpts has no
+		// case for it) and naming a policy is exactly what got us here,
+		// so it's implicitly allowed rather than requiring operators to
+		// redundantly declare it as a Default/Required.
+		allowedExtra := map[string]bool{PolicyOpt: true}
+		for k := range policy.Defaults {
+			allowedExtra[k] = true
+		}
+		for _, k := range policy.Required {
+			allowedExtra[k] = true
+		}
+		for k := range spec.Extra {
+			if !allowedExtra[k] {
+				return nil, fmt.Errorf("option %q is not allowed by policy %q", k, name)
+			}
+		}
+	}
+
+	if policy.MaxSizeBytes > 0 {
+		if sizeStr, ok := merged["size"]; ok {
+			if size, err := strconv.ParseInt(sizeStr, 10, 64); err == nil && size > policy.MaxSizeBytes {
+				merged["size"] = strconv.FormatInt(policy.MaxSizeBytes, 10)
+			}
+		}
+	}
+
+	if policy.FSType != "" {
+		if _, ok := merged["fstype"]; !ok {
+			merged["fstype"] = policy.FSType
+		}
+	}
+
+	return merged, nil
+}
+
+// RegisterPolicyRoutes mounts List/Get/Put/Delete handlers for policy
+// management onto mux, alongside the plugin's own Docker volume routes, so
+// policies can be managed at runtime without restarting the daemon.
+func (m *mountManager) RegisterPolicyRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("/Policies.List", m.handleListPolicies)
+	mux.HandleFunc("/Policies.Get", m.handleGetPolicy)
+	mux.HandleFunc("/Policies.Put", m.handlePutPolicy)
+	mux.HandleFunc("/Policies.Delete", m.handleDeletePolicy)
+}
+
+func (m *mountManager) handleListPolicies(w http.ResponseWriter, r *http.Request) {
+	policies, err := m.ListPolicies()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(policies)
+}
+
+func (m *mountManager) handleGetPolicy(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		http.Error(w, "missing name", http.StatusBadRequest)
+		return
+	}
+	policy, err := m.GetPolicy(name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if policy == nil {
+		http.NotFound(w, r)
+		return
+	}
+	json.NewEncoder(w).Encode(policy)
+}
+
+func (m *mountManager) handlePutPolicy(w http.ResponseWriter, r *http.Request) {
+	policy := Policy{}
+	if err := json.NewDecoder(r.Body).Decode(&policy); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if policy.Name == "" {
+		http.Error(w, "policy name is required", http.StatusBadRequest)
+		return
+	}
+	if err := m.PutPolicy(&policy); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (m *mountManager) handleDeletePolicy(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		http.Error(w, "missing name", http.StatusBadRequest)
+		return
+	}
+	if err := m.DeletePolicy(name); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
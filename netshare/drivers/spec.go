@@ -0,0 +1,220 @@
+package drivers
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Backend identifies which netshare driver a MountSpec targets.
+type Backend string
+
+const (
+	BackendNFS  Backend = "nfs"
+	BackendCIFS Backend = "cifs"
+	BackendCeph Backend = "ceph"
+	BackendEFS  Backend = "efs"
+)
+
+func (b Backend) validate() error {
+	switch b {
+	case "", BackendNFS, BackendCIFS, BackendCeph, BackendEFS:
+		return nil
+	default:
+		return fmt.Errorf("unknown backend %q", b)
+	}
+}
+
+// CredentialSource says where a MountSpec's Credentials came from: a
+// literal value set directly in opts, or a Vault/Consul path to resolve
+// at mount time via the renderer.
+type CredentialSource string
+
+const (
+	CredentialLiteral CredentialSource = "literal"
+	CredentialVault    CredentialSource = "vault"
+	CredentialConsul   CredentialSource = "consul"
+)
+
+// Credentials describes where a MountSpec's username/password comes from,
+// instead of every driver reparsing a "username"/"password"/"vault-path"
+// trio out of a flat map.
+type Credentials struct {
+	Source   CredentialSource
+	Username string
+	Password string
+
+	// Path is the Vault or Consul KV path Username/Password are resolved
+	// from when Source is CredentialVault or CredentialConsul.
+	Path string
+}
+
+// MountSpec is the typed, validated form of what used to travel as a bare
+// map[string]string in mount.Opts. Every driver-specific string ("share",
+// "create", "o", "size", ...) that each driver used to reparse out of the
+// map now has a named field here.
+type MountSpec struct {
+	Source  string
+	Target  string
+	Backend Backend
+
+	ReadOnly        bool
+	CreateIfMissing bool
+
+	Credentials Credentials
+
+	// MountOptions are passed straight through to the backend's mount
+	// command (the "-o" flags), e.g. ["vers=4", "sec=sys"].
+	MountOptions []string
+
+	FSType    string
+	SizeBytes int64
+
+	// Extra carries any opts key this MountSpec doesn't have a named
+	// field for, so driver-specific options keep working without a
+	// MountSpec change.
+	Extra map[string]string
+}
+
+// FromOpts translates the flat map[string]string Docker's
+// VolumeDriver.Create hands us into a validated MountSpec.
+func FromOpts(opts map[string]string) (*MountSpec, error) {
+	spec := &MountSpec{Extra: map[string]string{}}
+
+	for k, v := range opts {
+		switch k {
+		case ShareOpt:
+			spec.Source = v
+		case CreateOpt:
+			spec.CreateIfMissing = parseOptBool(v)
+		case "backend":
+			spec.Backend = Backend(v)
+		case "ro", "readonly":
+			spec.ReadOnly = parseOptBool(v)
+		case "o", "options":
+			spec.MountOptions = strings.Split(v, ",")
+		case "fstype":
+			spec.FSType = v
+		case "size":
+			size, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid size %q: %v", v, err)
+			}
+			spec.SizeBytes = size
+		case "username":
+			spec.Credentials.Username = v
+			if spec.Credentials.Source == "" {
+				spec.Credentials.Source = CredentialLiteral
+			}
+		case "password":
+			spec.Credentials.Password = v
+			if spec.Credentials.Source == "" {
+				spec.Credentials.Source = CredentialLiteral
+			}
+		case "vault-path":
+			spec.Credentials.Source = CredentialVault
+			spec.Credentials.Path = v
+		case "consul-path":
+			spec.Credentials.Source = CredentialConsul
+			spec.Credentials.Path = v
+		default:
+			spec.Extra[k] = v
+		}
+	}
+
+	if err := spec.Backend.validate(); err != nil {
+		return nil, err
+	}
+	return spec, nil
+}
+
+// parseOptBool mirrors GetOptionAsBool's long-standing "yes"/"true"
+// convention for boolean opts.
+func parseOptBool(v string) bool {
+	v = strings.ToLower(v)
+	return v == "yes" || v == "true"
+}
+
+// ToOpts flattens spec back into the map[string]string shape drivers have
+// historically consumed, for call sites (HasOption/GetOption/...) that
+// haven't migrated to MountSpec yet.
+func (s *MountSpec) ToOpts() map[string]string {
+	opts := map[string]string{}
+	for k, v := range s.Extra {
+		opts[k] = v
+	}
+	if s.Source != "" {
+		opts[ShareOpt] = s.Source
+	}
+	if s.CreateIfMissing {
+		opts[CreateOpt] = "true"
+	}
+	if s.Backend != "" {
+		opts["backend"] = string(s.Backend)
+	}
+	if s.ReadOnly {
+		opts["ro"] = "true"
+	}
+	if len(s.MountOptions) > 0 {
+		opts["o"] = strings.Join(s.MountOptions, ",")
+	}
+	if s.FSType != "" {
+		opts["fstype"] = s.FSType
+	}
+	if s.SizeBytes > 0 {
+		opts["size"] = strconv.FormatInt(s.SizeBytes, 10)
+	}
+	switch s.Credentials.Source {
+	case CredentialVault:
+		opts["vault-path"] = s.Credentials.Path
+	case CredentialConsul:
+		opts["consul-path"] = s.Credentials.Path
+	case CredentialLiteral:
+		if s.Credentials.Username != "" {
+			opts["username"] = s.Credentials.Username
+		}
+		if s.Credentials.Password != "" {
+			opts["password"] = s.Credentials.Password
+		}
+	}
+	return opts
+}
+
+// UnmarshalJSON accepts either a MountSpec's own JSON object or a legacy
+// flat map[string]string (as stored in mount.Opts before MountSpec
+// existed), translating the latter through FromOpts so older records keep
+// working. A document is treated as a MountSpec object when it has a
+// Backend, Credentials or MountOptions key at the top level (a marshalled
+// MountSpec always has all three); otherwise it's assumed to be a flat
+// option map.
+func (s *MountSpec) UnmarshalJSON(data []byte) error {
+	raw := map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	_, hasBackend := raw["Backend"]
+	_, hasCredentials := raw["Credentials"]
+	_, hasMountOptions := raw["MountOptions"]
+	if hasBackend || hasCredentials || hasMountOptions {
+		type alias MountSpec
+		var typed alias
+		if err := json.Unmarshal(data, &typed); err != nil {
+			return err
+		}
+		*s = MountSpec(typed)
+		return nil
+	}
+
+	flat := map[string]string{}
+	if err := json.Unmarshal(data, &flat); err != nil {
+		return fmt.Errorf("mount spec is neither a MountSpec object nor a flat option map: %v", err)
+	}
+	spec, err := FromOpts(flat)
+	if err != nil {
+		return err
+	}
+	*s = *spec
+	return nil
+}
@@ -0,0 +1,159 @@
+package drivers
+
+import (
+	"bytes"
+	"compress/gzip"
+	"container/list"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sync"
+)
+
+const (
+	// mountSchemaV1 is the envelope version written by this daemon.
+	// Bumping it lets future fields (PolicyName, LastMountAt, MountID,
+	// ...) be added without breaking older daemons still writing v1.
+	mountSchemaV1 = 1
+
+	// gzipThreshold is the payload size above which encodeMount
+	// compresses the record. Mount records with large Connections maps
+	// on big clusters cross this quickly.
+	gzipThreshold = 512
+
+	// defaultVolumeCacheSize bounds the in-memory LRU used by GetVolumes.
+	defaultVolumeCacheSize = 1024
+)
+
+// mountEnvelope is the versioned, optionally-compressed wrapper every
+// mount record is stored in: {"v":1,"alg":"gzip","payload":"<base64>"}.
+type mountEnvelope struct {
+	V       int    `json:"v"`
+	Alg     string `json:"alg"`
+	Payload string `json:"payload"`
+}
+
+// encodeMount marshals mnt into a mountEnvelope, gzip-compressing the
+// payload when it's large enough to be worth it.
+func encodeMount(mnt *mount) ([]byte, error) {
+	raw, err := json.Marshal(mnt)
+	if err != nil {
+		return nil, err
+	}
+
+	alg := "none"
+	payload := raw
+	if len(raw) > gzipThreshold {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		if _, err := gz.Write(raw); err != nil {
+			return nil, err
+		}
+		if err := gz.Close(); err != nil {
+			return nil, err
+		}
+		alg = "gzip"
+		payload = buf.Bytes()
+	}
+
+	envelope := mountEnvelope{V: mountSchemaV1, Alg: alg, Payload: base64.StdEncoding.EncodeToString(payload)}
+	return json.Marshal(envelope)
+}
+
+// decodeMount reverses encodeMount. It also accepts a bare, un-enveloped
+// mount JSON document, so records written by daemons that predate the
+// envelope keep working.
+func decodeMount(data []byte) (*mount, error) {
+	envelope := mountEnvelope{}
+	if err := json.Unmarshal(data, &envelope); err != nil || envelope.V == 0 {
+		mnt := mount{}
+		if err := json.Unmarshal(data, &mnt); err != nil {
+			return nil, err
+		}
+		return &mnt, nil
+	}
+
+	payload, err := base64.StdEncoding.DecodeString(envelope.Payload)
+	if err != nil {
+		return nil, err
+	}
+
+	switch envelope.Alg {
+	case "gzip":
+		gz, err := gzip.NewReader(bytes.NewReader(payload))
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		if payload, err = ioutil.ReadAll(gz); err != nil {
+			return nil, err
+		}
+	case "none", "":
+		// payload is already plain JSON.
+	default:
+		return nil, fmt.Errorf("unsupported mount envelope alg %q", envelope.Alg)
+	}
+
+	mnt := mount{}
+	if err := json.Unmarshal(payload, &mnt); err != nil {
+		return nil, err
+	}
+	return &mnt, nil
+}
+
+type mountCacheEntry struct {
+	key         string
+	modifyIndex uint64
+	mount       *mount
+}
+
+// mountCache is a small LRU keyed by (Key, ModifyIndex), so GetVolumes can
+// skip JSON/gzip decoding for records that haven't changed since the last
+// List call.
+type mountCache struct {
+	mu       sync.Mutex
+	capacity int
+	order    *list.List
+	entries  map[string]*list.Element
+}
+
+func newMountCache(capacity int) *mountCache {
+	return &mountCache{capacity: capacity, order: list.New(), entries: map[string]*list.Element{}}
+}
+
+func (c *mountCache) get(key string, modifyIndex uint64) (*mount, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := el.Value.(*mountCacheEntry)
+	if entry.modifyIndex != modifyIndex {
+		return nil, false
+	}
+	c.order.MoveToFront(el)
+	return entry.mount, true
+}
+
+func (c *mountCache) put(key string, modifyIndex uint64, mnt *mount) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[key]; ok {
+		el.Value = &mountCacheEntry{key: key, modifyIndex: modifyIndex, mount: mnt}
+		c.order.MoveToFront(el)
+		return
+	}
+
+	el := c.order.PushFront(&mountCacheEntry{key: key, modifyIndex: modifyIndex, mount: mnt})
+	c.entries[key] = el
+	if c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		if oldest != nil {
+			c.order.Remove(oldest)
+			delete(c.entries, oldest.Value.(*mountCacheEntry).key)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package drivers
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"text/template"
+)
+
+// renderer evaluates consul-template style directives found in mount.Opts
+// values - {{ key "..." }}, {{ secret "..." }}, {{ env "..." }}, {{ file
+// "..." }} and friends - against this manager's existing Consul and Vault
+// clients. This lets operators bake per-host or per-environment credentials
+// (CIFS username/password, Ceph keys, ...) into a single template stored in
+// Consul and have each host materialise its own view at mount time, instead
+// of hardcoding secrets into `docker run -o` options.
+type renderer struct {
+	manager *mountManager
+}
+
+func newRenderer(m *mountManager) *renderer {
+	return &renderer{manager: m}
+}
+
+type vaultSecret struct {
+	Data map[string]interface{}
+}
+
+func (r *renderer) funcMap() template.FuncMap {
+	return template.FuncMap{
+		"key":          r.key,
+		"keyOrDefault": r.keyOrDefault,
+		"ls":           r.ls,
+		"tree":         r.ls,
+		"secret":       r.secret,
+		"env":          os.Getenv,
+		"file":         r.file,
+	}
+}
+
+// render evaluates a single option value as a template. A parse or
+// execution error is returned to the caller rather than swallowed, so a
+// bad directive surfaces as a Docker plugin error instead of silently
+// becoming an empty string.
+func (r *renderer) render(text string) (string, error) {
+	if !strings.Contains(text, "{{") {
+		return text, nil
+	}
+	tmpl, err := template.New("opt").Funcs(r.funcMap()).Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, nil); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// renderOpts renders every value in opts, returning a new map so the
+// caller's original options are left untouched.
+func (r *renderer) renderOpts(opts map[string]string) (map[string]string, error) {
+	rendered := map[string]string{}
+	for k, v := range opts {
+		out, err := r.render(v)
+		if err != nil {
+			return nil, fmt.Errorf("rendering option %q: %v", k, err)
+		}
+		rendered[k] = out
+	}
+	return rendered, nil
+}
+
+func (r *renderer) key(path string) (string, error) {
+	kv, _, err := r.manager.consulKV.Get(path, nil)
+	if err != nil {
+		return "", err
+	}
+	if kv == nil {
+		return "", fmt.Errorf("key %q not found in consul", path)
+	}
+	return string(kv.Value), nil
+}
+
+func (r *renderer) keyOrDefault(path, def string) string {
+	val, err := r.key(path)
+	if err != nil {
+		return def
+	}
+	return val
+}
+
+func (r *renderer) ls(prefix string) (map[string]string, error) {
+	pairs, _, err := r.manager.consulKV.List(prefix, nil)
+	if err != nil {
+		return nil, err
+	}
+	out := map[string]string{}
+	for _, pair := range pairs {
+		out[pair.Key] = string(pair.Value)
+	}
+	return out, nil
+}
+
+func (r *renderer) secret(path string) (*vaultSecret, error) {
+	if r.manager.vault == nil {
+		return nil, errors.New("vault is not configured")
+	}
+	data, err := r.manager.vault.Read(path)
+	if err != nil {
+		return nil, err
+	}
+	if data == nil {
+		return nil, fmt.Errorf("secret %q not found in vault", path)
+	}
+	return &vaultSecret{Data: data}, nil
+}
+
+func (r *renderer) file(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
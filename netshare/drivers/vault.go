@@ -0,0 +1,272 @@
+package drivers
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	vaultApi "github.com/hashicorp/vault/api"
+)
+
+const defaultKubernetesJWTPath = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+
+// vaultManager owns a single long-lived, authenticated Vault client shared
+// by every mount. It replaces the old approach of logging in on every
+// Read, which made each mount pay a full AppRole login and hardcoded
+// InsecureSkipVerify.
+type vaultManager struct {
+	config *VaultConfig
+	client *vaultApi.Client
+
+	tokenMu       sync.Mutex
+	authenticated bool
+
+	cacheMu sync.RWMutex
+	cache   map[string]cachedSecret
+
+	kvVersionMu sync.Mutex
+	kvVersions  map[string]string
+}
+
+type cachedSecret struct {
+	data    map[string]interface{}
+	expires time.Time
+}
+
+// newVaultManager builds and authenticates a Vault client from config. It
+// returns nil when no Vault address is configured, matching the existing
+// convention that a nil vault client/config means "Vault isn't in use".
+func newVaultManager(config *VaultConfig) *vaultManager {
+	if config == nil || config.Address == "" {
+		return nil
+	}
+
+	vm := &vaultManager{config: config, cache: map[string]cachedSecret{}, kvVersions: map[string]string{}}
+
+	client, err := vm.newClient()
+	if err != nil {
+		log.Error("vault: failed to create client: ", err)
+		return nil
+	}
+	vm.client = client
+
+	if err := vm.authenticate(); err != nil {
+		log.Error("vault: authentication failed: ", err)
+	}
+	return vm
+}
+
+func (vm *vaultManager) newClient() (*vaultApi.Client, error) {
+	config := vaultApi.DefaultConfig()
+	config.Address = vm.config.Address
+	tlsConfig := &vaultApi.TLSConfig{
+		CACert:        vm.config.CACert,
+		CAPath:        vm.config.CAPath,
+		ClientCert:    vm.config.ClientCert,
+		ClientKey:     vm.config.ClientKey,
+		TLSServerName: vm.config.TLSServerName,
+		Insecure:      vm.config.Insecure,
+	}
+	if err := config.ConfigureTLS(tlsConfig); err != nil {
+		return nil, err
+	}
+	client, err := vaultApi.NewClient(config)
+	if err != nil {
+		return nil, err
+	}
+	log.Info("Created Vault Client. Address: ", vm.config.Address)
+	return client, nil
+}
+
+// authenticate logs in using the configured auth method, sets the
+// resulting token on the shared client, and starts a renewal watcher so
+// the token stays valid without a fresh login on every Read.
+func (vm *vaultManager) authenticate() error {
+	secret, err := vm.login()
+	if err != nil {
+		vm.tokenMu.Lock()
+		vm.authenticated = false
+		vm.tokenMu.Unlock()
+		return err
+	}
+
+	vm.tokenMu.Lock()
+	if secret.Auth != nil {
+		vm.client.SetToken(secret.Auth.ClientToken)
+	}
+	vm.authenticated = true
+	vm.tokenMu.Unlock()
+
+	go vm.watchRenewal(secret)
+	return nil
+}
+
+// isAuthenticated reports whether the last login (initial or
+// re-authentication after a failed renewal) succeeded.
+func (vm *vaultManager) isAuthenticated() bool {
+	vm.tokenMu.Lock()
+	defer vm.tokenMu.Unlock()
+	return vm.authenticated
+}
+
+func (vm *vaultManager) login() (*vaultApi.Secret, error) {
+	switch strings.ToLower(vm.config.AuthMethod) {
+	case "", "approle":
+		return vm.client.Logical().Write("auth/approle/login", map[string]interface{}{
+			"role_id":   vm.config.RoleId,
+			"secret_id": vm.config.SecretId,
+		})
+	case "kubernetes":
+		jwtPath := vm.config.KubernetesJWTPath
+		if jwtPath == "" {
+			jwtPath = defaultKubernetesJWTPath
+		}
+		jwt, err := ioutil.ReadFile(jwtPath)
+		if err != nil {
+			return nil, err
+		}
+		return vm.client.Logical().Write("auth/kubernetes/login", map[string]interface{}{
+			"role": vm.config.KubernetesRole,
+			"jwt":  string(jwt),
+		})
+	case "token":
+		if vm.config.Token == "" {
+			return nil, errors.New("vault auth method \"token\" requires VaultConfig.Token")
+		}
+		vm.client.SetToken(vm.config.Token)
+		return vm.client.Auth().Token().LookupSelf()
+	default:
+		return nil, fmt.Errorf("unknown vault auth method %q", vm.config.AuthMethod)
+	}
+}
+
+// watchRenewal keeps secret's lease alive via a LifetimeWatcher, applying
+// each renewed token under tokenMu, and triggers a full re-authentication
+// if the watcher ever gives up.
+func (vm *vaultManager) watchRenewal(secret *vaultApi.Secret) {
+	if secret == nil || secret.Auth == nil || !secret.Auth.Renewable {
+		return
+	}
+
+	watcher, err := vm.client.NewLifetimeWatcher(&vaultApi.LifetimeWatcherInput{Secret: secret})
+	if err != nil {
+		log.Error("vault: could not start token renewer: ", err)
+		return
+	}
+
+	go watcher.Start()
+	defer watcher.Stop()
+
+	for {
+		select {
+		case err := <-watcher.DoneCh():
+			if err != nil {
+				log.Error("vault: token renewal stopped, re-authenticating: ", err)
+			}
+			if err := vm.authenticate(); err != nil {
+				log.Error("vault: re-authentication failed: ", err)
+			}
+			return
+		case renewal := <-watcher.RenewCh():
+			vm.tokenMu.Lock()
+			vm.client.SetToken(renewal.Secret.Auth.ClientToken)
+			vm.tokenMu.Unlock()
+			log.Debug("vault: renewed token")
+		}
+	}
+}
+
+// Read fetches the secret at path, transparently unwrapping KV v2's
+// data/<path> envelope, and caches the result for its lease duration so
+// repeated Create/Mount calls for the same volume don't re-hit Vault.
+func (vm *vaultManager) Read(path string) (map[string]interface{}, error) {
+	if vm == nil || vm.client == nil {
+		return nil, nil
+	}
+
+	if data, ok := vm.cachedRead(path); ok {
+		return data, nil
+	}
+
+	if !vm.isAuthenticated() {
+		if err := vm.authenticate(); err != nil {
+			return nil, fmt.Errorf("vault: not authenticated: %v", err)
+		}
+	}
+
+	secret, err := vm.client.Logical().Read(vm.resolvePath(path))
+	if err != nil {
+		return nil, err
+	}
+	if secret == nil {
+		return nil, nil
+	}
+
+	data := secret.Data
+	if vm.isKVv2(path) {
+		if inner, ok := secret.Data["data"].(map[string]interface{}); ok {
+			data = inner
+		}
+	}
+
+	vm.cacheWrite(path, data, secret.LeaseDuration)
+	return data, nil
+}
+
+func (vm *vaultManager) cachedRead(path string) (map[string]interface{}, bool) {
+	vm.cacheMu.RLock()
+	defer vm.cacheMu.RUnlock()
+	entry, ok := vm.cache[path]
+	if !ok || time.Now().After(entry.expires) {
+		return nil, false
+	}
+	return entry.data, true
+}
+
+func (vm *vaultManager) cacheWrite(path string, data map[string]interface{}, leaseSeconds int) {
+	if leaseSeconds <= 0 {
+		return
+	}
+	vm.cacheMu.Lock()
+	defer vm.cacheMu.Unlock()
+	vm.cache[path] = cachedSecret{data: data, expires: time.Now().Add(time.Duration(leaseSeconds) * time.Second)}
+}
+
+// resolvePath rewrites path to <mount>/data/<rest> when its mount point is
+// a KV v2 engine, per Vault's KV v2 HTTP API.
+func (vm *vaultManager) resolvePath(path string) string {
+	if !vm.isKVv2(path) {
+		return path
+	}
+	parts := strings.SplitN(path, "/", 2)
+	if len(parts) != 2 {
+		return path
+	}
+	return parts[0] + "/data/" + parts[1]
+}
+
+// isKVv2 reports whether path's mount point is a KV version 2 secrets
+// engine, probing and caching sys/mounts once per mount point.
+func (vm *vaultManager) isKVv2(path string) bool {
+	mountPoint := strings.SplitN(path, "/", 2)[0]
+
+	vm.kvVersionMu.Lock()
+	defer vm.kvVersionMu.Unlock()
+	if version, ok := vm.kvVersions[mountPoint]; ok {
+		return version == "2"
+	}
+
+	mounts, err := vm.client.Sys().ListMounts()
+	if err != nil {
+		log.Error("vault: could not list mounts: ", err)
+		return false
+	}
+	for mp, m := range mounts {
+		vm.kvVersions[strings.TrimSuffix(mp, "/")] = m.Options["version"]
+	}
+	return vm.kvVersions[mountPoint] == "2"
+}
@@ -0,0 +1,222 @@
+package drivers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	vaultApi "github.com/hashicorp/vault/api"
+)
+
+// fakeVault is a minimal hand-rolled stand-in for Vault's HTTP API,
+// covering only the endpoints vaultManager actually exercises: token
+// self-lookup, sys/mounts (for KV v2 detection), and generic secret
+// read/write. This is deliberately not github.com/hashicorp/vault/vault +
+// .../http's real test core - those pull in the entire Vault server
+// (every cloud KMS wrapper, k8s client-go, ...) as a test-only dependency
+// for what is otherwise a thin vault/api client wrapper.
+type fakeVault struct {
+	mu      sync.Mutex
+	token   string
+	mounts  map[string]string // mount path ("secret/", "kv2/") -> kv version
+	secrets map[string]map[string]interface{}
+}
+
+func newFakeVault(token string) *fakeVault {
+	return &fakeVault{
+		token:   token,
+		mounts:  map[string]string{"secret/": "1"},
+		secrets: map[string]map[string]interface{}{},
+	}
+}
+
+func (f *fakeVault) server() *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/auth/token/lookup-self", f.handleLookupSelf)
+	mux.HandleFunc("/v1/sys/mounts", f.handleListMounts)
+	mux.HandleFunc("/v1/sys/mounts/", f.handleCreateMount)
+	mux.HandleFunc("/v1/", f.handleSecret)
+	return httptest.NewServer(mux)
+}
+
+func (f *fakeVault) handleLookupSelf(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, map[string]interface{}{
+		"data": map[string]interface{}{"id": f.token, "renewable": false},
+	})
+}
+
+func (f *fakeVault) handleListMounts(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	mounts := map[string]interface{}{}
+	for path, version := range f.mounts {
+		mounts[path] = map[string]interface{}{
+			"type":    "kv",
+			"options": map[string]string{"version": version},
+		}
+	}
+	writeJSON(w, map[string]interface{}{"data": mounts})
+}
+
+func (f *fakeVault) handleCreateMount(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/v1/sys/mounts/")
+
+	var body struct {
+		Options map[string]string `json:"options"`
+	}
+	json.NewDecoder(r.Body).Decode(&body)
+
+	version := body.Options["version"]
+	if version == "" {
+		version = "1"
+	}
+
+	f.mu.Lock()
+	f.mounts[path+"/"] = version
+	f.mu.Unlock()
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleSecret stores and replays whatever JSON body a caller writes at
+// path, unchanged. That's enough to emulate both KV v1 (the body a caller
+// writes is the secret data as-is) and KV v2 (the body is {"data": {...}})
+// without the fake needing to know which version is in play.
+func (f *fakeVault) handleSecret(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/v1/")
+
+	switch r.Method {
+	case http.MethodPut, http.MethodPost:
+		body := map[string]interface{}{}
+		json.NewDecoder(r.Body).Decode(&body)
+		f.mu.Lock()
+		f.secrets[path] = body
+		f.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodGet:
+		f.mu.Lock()
+		data, ok := f.secrets[path]
+		f.mu.Unlock()
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		writeJSON(w, map[string]interface{}{"data": data})
+	default:
+		http.Error(w, "unsupported method", http.StatusMethodNotAllowed)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// newTestVaultManager points a vaultManager at a fakeVault server using
+// the "token" auth method, which needs nothing more than the fake's
+// token-lookup-self endpoint to authenticate.
+func newTestVaultManager(t *testing.T) (*vaultManager, func()) {
+	t.Helper()
+
+	const rootToken = "test-root-token"
+	server := newFakeVault(rootToken).server()
+
+	config := &VaultConfig{
+		Address:    server.URL,
+		AuthMethod: "token",
+		Token:      rootToken,
+	}
+
+	vm := newVaultManager(config)
+	if vm == nil {
+		server.Close()
+		t.Fatal("newVaultManager returned nil")
+	}
+	return vm, server.Close
+}
+
+func TestVaultManagerTokenAuth(t *testing.T) {
+	vm, cleanup := newTestVaultManager(t)
+	defer cleanup()
+
+	if !vm.isAuthenticated() {
+		t.Fatal("expected vaultManager to be authenticated after token login")
+	}
+}
+
+func TestVaultManagerReadKVv1(t *testing.T) {
+	vm, cleanup := newTestVaultManager(t)
+	defer cleanup()
+
+	if _, err := vm.client.Logical().Write("secret/myapp", map[string]interface{}{"password": "hunter2"}); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := vm.Read("secret/myapp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data["password"] != "hunter2" {
+		t.Fatalf("expected password %q, got %v", "hunter2", data["password"])
+	}
+}
+
+func TestVaultManagerReadKVv2(t *testing.T) {
+	vm, cleanup := newTestVaultManager(t)
+	defer cleanup()
+
+	if err := vm.client.Sys().Mount("kv2", &vaultApi.MountInput{
+		Type:    "kv",
+		Options: map[string]string{"version": "2"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := vm.client.Logical().Write("kv2/data/myapp", map[string]interface{}{
+		"data": map[string]interface{}{"password": "hunter2"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Read is given the bare "<mount>/<path>" form: resolvePath/isKVv2
+	// must transparently rewrite it to "kv2/data/myapp" and unwrap the
+	// .Data.data envelope, not return it as-is.
+	data, err := vm.Read("kv2/myapp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data["password"] != "hunter2" {
+		t.Fatalf("expected password %q, got %v", "hunter2", data["password"])
+	}
+}
+
+func TestVaultManagerReadCachesUntilExpiry(t *testing.T) {
+	vm, cleanup := newTestVaultManager(t)
+	defer cleanup()
+
+	vm.cacheWrite("secret/cached", map[string]interface{}{"password": "first"}, 60)
+
+	if _, err := vm.client.Logical().Write("secret/cached", map[string]interface{}{"password": "second"}); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := vm.Read("secret/cached")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data["password"] != "first" {
+		t.Fatalf("expected the cached value %q, got %v (cache was bypassed)", "first", data["password"])
+	}
+}
+
+func TestVaultManagerUnknownAuthMethod(t *testing.T) {
+	config := &VaultConfig{Address: "http://127.0.0.1:1", AuthMethod: "bogus"}
+	vm := &vaultManager{config: config}
+	if _, err := vm.login(); err == nil {
+		t.Fatal("expected an error for an unknown auth method")
+	}
+}